@@ -0,0 +1,260 @@
+/*
+Copyright 2011 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mongo registers the "mongodbblobs" blobserver storage type,
+// which stores blobs as GridFS files in MongoDB. Combined with the
+// "mongodbindexer" storage type in pkg/index, it lets a Perkeep server
+// run entirely on top of MongoDB.
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"camlistore.org/third_party/launchpad.net/mgo"
+	"camlistore.org/third_party/launchpad.net/mgo/bson"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/index"
+	"perkeep.org/pkg/jsonconfig"
+)
+
+var _ blobserver.Storage = (*mongoStorage)(nil)
+
+// mongoStorage stores blobs as files in a MongoDB GridFS bucket. It
+// reuses index.MongoWrapper for connection config and session caching,
+// so the blob store and the mongodbindexer stay in sync on auth,
+// replica-set, TLS and URI support instead of drifting apart.
+type mongoStorage struct {
+	mgw    *index.MongoWrapper
+	bucket string // GridFS bucket name, e.g. "fs" for the default "fs.files"/"fs.chunks" collections
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("mongodbblobs", blobserver.StorageConstructor(newFromConfig))
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
+	sto := &mongoStorage{
+		mgw: &index.MongoWrapper{
+			Servers:        config.OptionalString("servers", "localhost"),
+			User:           config.OptionalString("user", ""),
+			Password:       config.OptionalString("password", ""),
+			Database:       config.RequiredString("database"),
+			AuthDatabase:   config.OptionalString("authDatabase", ""),
+			ReplicaSetName: config.OptionalString("replicaSet", ""),
+			TLS:            config.OptionalBool("tls", false),
+			TLSCAFile:      config.OptionalString("tlsCAFile", ""),
+			URI:            config.OptionalString("uri", ""),
+		},
+		bucket: config.OptionalString("bucket", "fs"),
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Dial eagerly, so a misconfiguration is reported at startup
+	// rather than on the first blob access.
+	session, err := sto.mgw.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	session.Close()
+	return sto, nil
+}
+
+// gridFile is the metadata document stored alongside each blob's
+// content in the GridFS "files" collection.
+type gridFile struct {
+	Filename string `bson:"filename"`
+	Length   int64  `bson:"length"`
+	Meta     bson.M `bson:"metadata"`
+}
+
+// gridFS returns a session copy together with the configured GridFS
+// bucket on it. Callers own the session and must Close it when done.
+func (sto *mongoStorage) gridFS() (*mgo.Session, *mgo.GridFS, error) {
+	session, err := sto.mgw.GetConnection()
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, session.DB(sto.mgw.Database).GridFS(sto.bucket), nil
+}
+
+// gridFileReader ties a GridFile's lifetime to the session it was
+// opened on, so Fetch's caller closing the returned ReadCloser also
+// releases the underlying connection.
+type gridFileReader struct {
+	*mgo.GridFile
+	session *mgo.Session
+}
+
+func (g *gridFileReader) Close() error {
+	err := g.GridFile.Close()
+	g.session.Close()
+	return err
+}
+
+func (sto *mongoStorage) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	session, gfs, err := sto.gridFS()
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := gfs.Open(br.String())
+	if err != nil {
+		session.Close()
+		if err == mgo.NotFound {
+			return nil, 0, os.ErrNotExist
+		}
+		return nil, 0, err
+	}
+	return &gridFileReader{GridFile: f, session: session}, uint32(f.Size()), nil
+}
+
+// ReceiveBlob checks for an existing GridFS file named after br before
+// writing a new one, so that receiving an already-stored blob (which
+// sync/mirror paths do routinely) doesn't pile up redundant revisions
+// under the same filename. This check-then-act isn't atomic: two
+// concurrent ReceiveBlob calls for the same brand-new ref can both
+// miss the check and both Create. That's harmless rather than
+// incorrect, since blob.Refs are content-addressed — any files left
+// under that filename are byte-for-byte identical — but it does mean
+// the "at most one revision per ref" property is a best effort, not a
+// guarantee, under concurrent first-writers.
+func (sto *mongoStorage) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	session, gfs, err := sto.gridFS()
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	defer session.Close()
+
+	var existing gridFile
+	err = gfs.Find(bson.M{"filename": br.String()}).One(&existing)
+	if err == nil {
+		return blob.SizedRef{Ref: br, Size: uint32(existing.Length)}, nil
+	}
+	if err != mgo.NotFound {
+		return blob.SizedRef{}, err
+	}
+
+	f, err := gfs.Create(br.String())
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	// Also record the ref in the file's metadata. The lookups in this
+	// file (Fetch, StatBlobs, RemoveBlobs) match on the filename only.
+	f.SetMeta(bson.M{"ref": br.String()})
+	n, err := io.Copy(f, source)
+	if err != nil {
+		f.Close()
+		return blob.SizedRef{}, err
+	}
+	if err := f.Close(); err != nil {
+		return blob.SizedRef{}, err
+	}
+	return blob.SizedRef{Ref: br, Size: uint32(n)}, nil
+}
+
+func (sto *mongoStorage) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
+	session, gfs, err := sto.gridFS()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	for _, br := range blobs {
+		if err := gfs.Remove(br.String()); err != nil && err != mgo.NotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sto *mongoStorage) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	session, gfs, err := sto.gridFS()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	for _, br := range blobs {
+		var doc gridFile
+		err := gfs.Find(bson.M{"filename": br.String()}).One(&doc)
+		if err == mgo.NotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(blob.SizedRef{Ref: br, Size: uint32(doc.Length)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextStr returns the string lexically greater than the provided s
+// with the same length as s. It mirrors the helper of the same name
+// in pkg/blobserver/s3, which EnumerateBlobs below follows the same
+// ordering contract as.
+func nextStr(s string) string {
+	if s == "" {
+		return s
+	}
+	b := []byte(s)
+	i := len(b)
+	for i > 0 {
+		i--
+		b[i]++
+		if b[i] != 0 {
+			break
+		}
+	}
+	return string(b)
+}
+
+func (sto *mongoStorage) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, after string, limit int) (err error) {
+	defer close(dest)
+	session, gfs, err := sto.gridFS()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	startAt := after
+	if _, ok := blob.Parse(after); ok {
+		startAt = nextStr(after)
+	}
+	iter := gfs.Find(bson.M{"filename": bson.M{"$gt": startAt}}).Sort("filename").Limit(limit).Iter()
+	var doc gridFile
+	n := 0
+	for n < limit && iter.Next(&doc) {
+		br, ok := blob.Parse(doc.Filename)
+		if !ok {
+			iter.Close()
+			return fmt.Errorf("non-Perkeep object named %q found in mongo GridFS bucket %q", doc.Filename, sto.bucket)
+		}
+		select {
+		case dest <- blob.SizedRef{Ref: br, Size: uint32(doc.Length)}:
+		case <-ctx.Done():
+			iter.Close()
+			return ctx.Err()
+		}
+		n++
+	}
+	return iter.Close()
+}
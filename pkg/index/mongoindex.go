@@ -17,8 +17,15 @@ limitations under the License.
 package index
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,6 +38,19 @@ import (
 	"camlistore.org/third_party/launchpad.net/mgo/bson"
 )
 
+// maxBulkOps caps the number of operations sent in a single mgo Bulk
+// request, to stay under the Mongo wire-protocol message size limit
+// when a batch from the indexer grows large.
+//
+// This chunking is the only half of "raise the batch size limit" done
+// here: the BatchMutation/batch type that BeginBatch/CommitBatch operate
+// on, and any pre-commit ceiling on how large one is allowed to grow
+// before CommitBatch is called, live outside this package's visible
+// files and were never touched by this change. If such a ceiling exists
+// upstream, it was not raised; this const only controls how a
+// (possibly large) already-built batch is split into round-trips.
+const maxBulkOps = 1000
+
 // We explicitely separate the key and the value in a document,
 // instead of simply storing as key:value, to avoid problems
 // such as "." being an illegal char in a key name. Also because
@@ -48,11 +68,32 @@ type MongoWrapper struct {
 	Password   string
 	Database   string
 	Collection string
+
+	// AuthDatabase is the database User/Password are authenticated
+	// against. It defaults to "admin".
+	AuthDatabase string
+
+	// ReplicaSetName, if set, requires Servers to belong to the
+	// named replica set.
+	ReplicaSetName string
+
+	// TLS dials Servers over TLS. TLSCAFile, if set, additionally
+	// verifies the server certificate against the given CA and
+	// implies TLS.
+	TLS       bool
+	TLSCAFile string
+
+	// URI, if set, is a full mongodb:// connection string and takes
+	// precedence over Servers/User/Password/AuthDatabase/ReplicaSetName/TLS*.
+	URI string
+
+	mu      sync.Mutex // guards session
+	session *mgo.Session
 }
 
 // Note that Ping won't work with old (1.2) mongo servers.
 func (mgw *MongoWrapper) TestConnection(timeout int64) bool {
-	session, err := mgo.Dial(mgw.Servers)
+	session, err := mgw.dial()
 	if err != nil {
 		return false
 	}
@@ -65,32 +106,89 @@ func (mgw *MongoWrapper) TestConnection(timeout int64) bool {
 	return true
 }
 
-func (mgw *MongoWrapper) getConnection() (*mgo.Session, error) {
-	// TODO(mpl): do some "client caching" as in mysql, to avoid systematically dialing?
-	session, err := mgo.Dial(mgw.Servers)
+// dialInfo builds a mgo.DialInfo from mgw's fields.
+func (mgw *MongoWrapper) dialInfo() (*mgo.DialInfo, error) {
+	info := &mgo.DialInfo{
+		Addrs:          strings.Split(mgw.Servers, ","),
+		ReplicaSetName: mgw.ReplicaSetName,
+		Username:       mgw.User,
+		Password:       mgw.Password,
+	}
+	if mgw.User != "" {
+		source := mgw.AuthDatabase
+		if source == "" {
+			source = "admin"
+		}
+		info.Source = source
+	}
+	if mgw.TLS || mgw.TLSCAFile != "" {
+		tlsConfig := &tls.Config{}
+		if mgw.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(mgw.TLSCAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("mongoindex: no certificates found in %v", mgw.TLSCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return tls.Dial("tcp", addr.String(), tlsConfig)
+		}
+	}
+	return info, nil
+}
+
+// dial establishes a fresh session, either from mgw.URI if set, or
+// from the Servers/User/Password/... fields otherwise.
+func (mgw *MongoWrapper) dial() (*mgo.Session, error) {
+	if mgw.URI != "" {
+		info, err := mgo.ParseURL(mgw.URI)
+		if err != nil {
+			return nil, err
+		}
+		return mgo.DialWithInfo(info)
+	}
+	info, err := mgw.dialInfo()
 	if err != nil {
 		return nil, err
 	}
-	session.SetMode(mgo.Monotonic, true)
-	session.SetSafe(&mgo.Safe{})
-	return session, nil
+	return mgo.DialWithInfo(info)
+}
+
+// GetConnection returns a copy of mgw's cached session, dialing and
+// caching one first if needed. Callers own the returned session and
+// must Close it when done. It is exported so other packages needing a
+// MongoDB connection (e.g. the "mongodbblobs" blobserver storage) can
+// share this wrapper's config and session cache instead of redialing.
+func (mgw *MongoWrapper) GetConnection() (*mgo.Session, error) {
+	mgw.mu.Lock()
+	defer mgw.mu.Unlock()
+	if mgw.session == nil {
+		session, err := mgw.dial()
+		if err != nil {
+			return nil, err
+		}
+		session.SetMode(mgo.Monotonic, true)
+		session.SetSafe(&mgo.Safe{})
+		mgw.session = session
+	}
+	return mgw.session.Copy(), nil
 }
 
-// TODO(mpl): I'm only calling getCollection at the beginning, and 
-// keeping the collection around and reusing it everywhere, instead
-// of calling getCollection everytime, because that's the easiest.
-// But I can easily change that. Gustavo says it does not make 
-// much difference either way.
-// Brad, what do you think?
-func (mgw *MongoWrapper) getCollection() (*mgo.Collection, error) {
-	session, err := mgw.getConnection()
+// collection returns a session copy together with the configured
+// collection on it. Callers own the session and must Close it when
+// done with the collection.
+func (mgw *MongoWrapper) collection() (*mgo.Session, *mgo.Collection, error) {
+	session, err := mgw.GetConnection()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	session.SetSafe(&mgo.Safe{})
 	session.SetMode(mgo.Strong, true)
-	c := session.DB(mgw.Database).C(mgw.Collection)
-	return c, nil
+	return session, session.DB(mgw.Database).C(mgw.Collection), nil
 }
 
 func init() {
@@ -99,20 +197,32 @@ func init() {
 }
 
 func newMongoIndex(mgw *MongoWrapper) (*Index, error) {
-	db, err := mgw.getCollection()
+	// Dial (and cache the session) eagerly, so a misconfiguration is
+	// reported at startup rather than on the first index access. The
+	// copy GetConnection hands back isn't otherwise needed here, so
+	// close it right away instead of leaking it.
+	session, err := mgw.GetConnection()
 	if err != nil {
 		return nil, err
 	}
-	mongoStorage := &mongoKeys{db: db}
+	session.Close()
+	mongoStorage := &mongoKeys{mgw: mgw}
 	return New(mongoStorage), nil
 }
 
 func newMongoIndexFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
 	blobPrefix := config.RequiredString("blobSource")
 	mgw := &MongoWrapper{
-		Servers:    config.OptionalString("servers", "localhost"),
-		Database:   config.RequiredString("database"),
-		Collection: collectionName,
+		Servers:        config.OptionalString("servers", "localhost"),
+		User:           config.OptionalString("user", ""),
+		Password:       config.OptionalString("password", ""),
+		Database:       config.RequiredString("database"),
+		Collection:     collectionName,
+		AuthDatabase:   config.OptionalString("authDatabase", ""),
+		ReplicaSetName: config.OptionalString("replicaSet", ""),
+		TLS:            config.OptionalBool("tls", false),
+		TLSCAFile:      config.OptionalString("tlsCAFile", ""),
+		URI:            config.OptionalString("uri", ""),
 	}
 	if err := config.Validate(); err != nil {
 		return nil, err
@@ -147,49 +257,59 @@ func newMongoIndexFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobs
 	return ix, err
 }
 
-// Implementation of index Iterator
-type mongoStrIterator struct {
-	res bson.M
-	*mgo.Iter
+// kv is decoded fresh for every document a mongoIter visits, so Key and
+// Value always reflect the current row instead of one reused bson.M
+// clobbered by the next Next call.
+type kv struct {
+	Key   string `bson:"key"`
+	Value string `bson:"value"`
 }
 
-func (s mongoStrIterator) Next() bool {
-	return s.Iter.Next(&s.res)
+// Implementation of index Iterator
+type mongoIter struct {
+	session *mgo.Session // owned by this iterator; copied in Find, closed in Close
+	iter    *mgo.Iter
+	cur     kv
+	err     error // set if the iterator couldn't even be started
 }
 
-func (s mongoStrIterator) Key() (key string) {
-	key, ok := (s.res[mgoKey]).(string)
-	if !ok {
-		return ""
+func (it *mongoIter) Next() bool {
+	if it.iter == nil {
+		return false
 	}
-	return key
+	return it.iter.Next(&it.cur)
 }
 
-func (s mongoStrIterator) Value() (value string) {
-	value, ok := (s.res[mgoValue]).(string)
-	if !ok {
-		return ""
-	}
-	return value
-}
+func (it *mongoIter) Key() string   { return it.cur.Key }
+func (it *mongoIter) Value() string { return it.cur.Value }
 
-func (s mongoStrIterator) Close() error {
-	// TODO(mpl): think about anything more to be done here.
-	return nil
+func (it *mongoIter) Close() error {
+	if it.iter == nil {
+		return it.err
+	}
+	closeErr := it.iter.Close()
+	err := it.iter.Err()
+	if err == nil {
+		err = closeErr
+	}
+	it.session.Close()
+	return err
 }
 
 // Implementation of IndexStorage
 type mongoKeys struct {
-	mu sync.Mutex // guards db
-	db *mgo.Collection
+	mgw *MongoWrapper
 }
 
 func (mk *mongoKeys) Get(key string) (string, error) {
-	mk.mu.Lock()
-	defer mk.mu.Unlock()
+	session, c, err := mk.mgw.collection()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
 	res := bson.M{}
-	q := mk.db.Find(&bson.M{mgoKey: key})
-	err := q.One(&res)
+	q := c.Find(&bson.M{mgoKey: key})
+	err = q.One(&res)
 	if err != nil {
 		if err == mgo.NotFound {
 			return "", ErrNotFound
@@ -201,54 +321,127 @@ func (mk *mongoKeys) Get(key string) (string, error) {
 }
 
 func (mk *mongoKeys) Find(key string) Iterator {
-	mk.mu.Lock()
-	defer mk.mu.Unlock()
-	// TODO(mpl): escape other special chars, or maybe replace $regex with something
-	// more suited if possible.
-	cleanedKey := strings.Replace(key, "|", `\|`, -1)
-	iter := mk.db.Find(&bson.M{mgoKey: &bson.M{"$regex": "^" + cleanedKey}}).Sort(&bson.M{mgoKey: 1}).Iter()
-	return mongoStrIterator{res: bson.M{}, Iter: iter}
+	session, c, err := mk.mgw.collection()
+	if err != nil {
+		return &mongoIter{err: err}
+	}
+	cleanedKey := regexp.QuoteMeta(key)
+	iter := c.Find(&bson.M{mgoKey: &bson.M{"$regex": "^" + cleanedKey}}).Sort(&bson.M{mgoKey: 1}).Iter()
+	return &mongoIter{session: session, iter: iter}
 }
 
 func (mk *mongoKeys) Set(key, value string) error {
-	mk.mu.Lock()
-	defer mk.mu.Unlock()
-	_, err := mk.db.Upsert(&bson.M{mgoKey: key}, &bson.M{mgoKey: key, mgoValue: value})
+	session, c, err := mk.mgw.collection()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	_, err = c.Upsert(&bson.M{mgoKey: key}, &bson.M{mgoKey: key, mgoValue: value})
 	return err
 }
 
 // Delete removes the document with the matching key.
 // If key is "", it removes all documents.
 func (mk *mongoKeys) Delete(key string) error {
-	mk.mu.Lock()
-	defer mk.mu.Unlock()
+	session, c, err := mk.mgw.collection()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
 	if key == "" {
-		return mk.db.RemoveAll(nil)
+		return c.RemoveAll(nil)
 	}
-	return mk.db.Remove(&bson.M{mgoKey: key})
+	return c.Remove(&bson.M{mgoKey: key})
 }
 
 func (mk *mongoKeys) BeginBatch() BatchMutation {
 	return &batch{}
 }
 
+// CommitBatch applies b via commitBatch, in chunks of at most
+// maxBulkOps operations. Operations within a chunk are applied in order
+// (we don't call Unordered). Each chunk is a separate round-trip, so the
+// batch as a whole is not applied atomically: if a chunk fails, the
+// chunks before it stay applied.
+//
+// maxBulkOps only bounds the size of each round-trip; nothing here
+// limits how many mutations a batch may hold.
 func (mk *mongoKeys) CommitBatch(bm BatchMutation) error {
 	b, ok := bm.(*batch)
 	if !ok {
 		return errors.New("invalid batch type; not an instance returned by BeginBatch")
 	}
-	mk.mu.Lock()
-	defer mk.mu.Unlock()
-	for _, m := range b.m {
-		if m.delete {
-			if err := mk.db.Remove(bson.M{mgoKey: m.key}); err != nil {
-				return err
+	session, c, err := mk.mgw.collection()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	muts := make([]mongoMutation, len(b.m))
+	for i, m := range b.m {
+		muts[i] = mongoMutation{key: m.key, value: m.value, delete: m.delete}
+	}
+	return commitBatch(mgoCollection{c}, muts)
+}
+
+// mongoMutation is a package-local copy of a single batch mutation,
+// decoupled from the BatchMutation/batch types so commitBatch below
+// can be exercised with a fake collection in tests.
+type mongoMutation struct {
+	key    string
+	value  string
+	delete bool
+}
+
+// bulkOp is the subset of *mgo.Bulk's API that commitBatch needs.
+type bulkOp interface {
+	Upsert(pairs ...interface{})
+	Remove(selectors ...interface{})
+	Run() (*mgo.BulkResult, error)
+}
+
+// bulkCollection is the subset of *mgo.Collection's API that
+// commitBatch needs to obtain a bulkOp. mgoCollection adapts the real
+// *mgo.Collection to it; tests substitute their own fake.
+type bulkCollection interface {
+	Bulk() bulkOp
+}
+
+type mgoCollection struct {
+	c *mgo.Collection
+}
+
+func (m mgoCollection) Bulk() bulkOp { return m.c.Bulk() }
+
+// commitBatch applies muts in chunks of at most maxBulkOps operations,
+// one Bulk Run per chunk, via mgo's Bulk API. Operations within a chunk
+// are applied in order (we don't call Unordered). The chunks are not
+// applied atomically: when a chunk fails, commitBatch returns its error
+// and the chunks run before it stay applied.
+func commitBatch(c bulkCollection, muts []mongoMutation) error {
+	for lo := 0; lo < len(muts); lo += maxBulkOps {
+		hi := lo + maxBulkOps
+		if hi > len(muts) {
+			hi = len(muts)
+		}
+		chunk := muts[lo:hi]
+		bulk := c.Bulk()
+		for _, m := range chunk {
+			if m.delete {
+				bulk.Remove(bson.M{mgoKey: m.key})
+			} else {
+				bulk.Upsert(bson.M{mgoKey: m.key}, bson.M{mgoKey: m.key, mgoValue: m.value})
 			}
-		} else {
-			if _, err := mk.db.Upsert(&bson.M{mgoKey: m.key}, &bson.M{mgoKey: m.key, mgoValue: m.value}); err != nil {
-				return err
+		}
+		res, err := bulk.Run()
+		if err != nil {
+			if bulkErr, ok := err.(*mgo.BulkError); ok {
+				for _, c := range bulkErr.Cases() {
+					return fmt.Errorf("mongoindex: bulk commit failed for key %q: %v", chunk[c.Index].key, c.Err)
+				}
 			}
+			return fmt.Errorf("mongoindex: bulk commit of %d ops failed: %v", len(chunk), err)
 		}
+		log.Printf("mongoindex: bulk commit of %d ops (%d matched, %d modified)", len(chunk), res.Matched, res.Modified)
 	}
 	return nil
 }
@@ -0,0 +1,108 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestFindInterleavedWithSet exercises two concurrent mongoKeys.Find
+// iterators against a collection that a third goroutine is
+// concurrently Set-ing, to demonstrate that each iterator decodes its
+// own rows (rather than clobbering a shared bson.M) and that its
+// session isn't closed out from under it by another iterator's Close.
+//
+// It requires a real MongoDB reachable at $CAMLI_MONGO_TEST_SERVER (or
+// localhost, by default), and is skipped if none is reachable.
+func TestFindInterleavedWithSet(t *testing.T) {
+	servers := os.Getenv("CAMLI_MONGO_TEST_SERVER")
+	if servers == "" {
+		servers = "localhost"
+	}
+	mgw := &MongoWrapper{Servers: servers, Database: "camlitest_mongoindex"}
+	session, err := mgw.GetConnection()
+	if err != nil {
+		t.Skipf("no reachable mongo server: %v", err)
+	}
+	session.Close()
+
+	mk := &mongoKeys{mgw: mgw}
+	defer func() {
+		if err := mk.Delete(""); err != nil {
+			t.Logf("cleanup: %v", err)
+		}
+	}()
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		if err := mk.Set(fmt.Sprintf("stress|%03d", i), "v1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := make(chan error, 3)
+	var wg sync.WaitGroup
+
+	readAll := func() {
+		defer wg.Done()
+		it := mk.Find("stress|")
+		lastKey := ""
+		count := 0
+		for it.Next() {
+			k, v := it.Key(), it.Value()
+			if lastKey != "" && k <= lastKey {
+				errs <- fmt.Errorf("iterator returned %q out of order after %q", k, lastKey)
+				return
+			}
+			if v == "" {
+				errs <- fmt.Errorf("iterator returned empty value for key %q", k)
+				return
+			}
+			lastKey = k
+			count++
+		}
+		if err := it.Close(); err != nil {
+			errs <- fmt.Errorf("Close: %v", err)
+			return
+		}
+		if count != n {
+			errs <- fmt.Errorf("iterator saw %d keys, want %d", count, n)
+		}
+	}
+
+	wg.Add(3)
+	go readAll()
+	go readAll()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if err := mk.Set(fmt.Sprintf("stress|%03d", i), "v2"); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"fmt"
+	"testing"
+
+	"camlistore.org/third_party/launchpad.net/mgo"
+)
+
+// fakeBulk is a recording stand-in for *mgo.Bulk.
+type fakeBulk struct {
+	upserts int
+	removes int
+	runs    int
+}
+
+func (b *fakeBulk) Upsert(pairs ...interface{}) {
+	b.upserts += len(pairs) / 2
+}
+
+func (b *fakeBulk) Remove(selectors ...interface{}) {
+	b.removes += len(selectors)
+}
+
+func (b *fakeBulk) Run() (*mgo.BulkResult, error) {
+	b.runs++
+	return &mgo.BulkResult{Matched: b.upserts + b.removes, Modified: b.upserts}, nil
+}
+
+// fakeCollection is a recording stand-in for *mgo.Collection, counting
+// how many times Bulk is obtained (i.e. how many round-trips to Mongo
+// a commitBatch call would make).
+type fakeCollection struct {
+	bulks []*fakeBulk
+}
+
+func (c *fakeCollection) Bulk() bulkOp {
+	b := &fakeBulk{}
+	c.bulks = append(c.bulks, b)
+	return b
+}
+
+func TestCommitBatchSingleRoundTrip(t *testing.T) {
+	const nUpserts, nDeletes = 3, 2
+	var muts []mongoMutation
+	for i := 0; i < nUpserts; i++ {
+		muts = append(muts, mongoMutation{key: fmt.Sprintf("upsert-%d", i), value: "v"})
+	}
+	for i := 0; i < nDeletes; i++ {
+		muts = append(muts, mongoMutation{key: fmt.Sprintf("delete-%d", i), delete: true})
+	}
+
+	c := &fakeCollection{}
+	if err := commitBatch(c, muts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.bulks) != 1 {
+		t.Fatalf("got %d Bulk() calls (round-trips), want 1 for a batch under maxBulkOps", len(c.bulks))
+	}
+	b := c.bulks[0]
+	if b.runs != 1 {
+		t.Errorf("got %d Run() calls, want 1", b.runs)
+	}
+	if b.upserts != nUpserts {
+		t.Errorf("got %d upserts, want %d", b.upserts, nUpserts)
+	}
+	if b.removes != nDeletes {
+		t.Errorf("got %d removes, want %d", b.removes, nDeletes)
+	}
+}
+
+func TestCommitBatchChunksLargeBatches(t *testing.T) {
+	n := maxBulkOps + maxBulkOps/2
+	muts := make([]mongoMutation, n)
+	for i := range muts {
+		muts[i] = mongoMutation{key: fmt.Sprintf("key-%d", i), value: "v"}
+	}
+
+	c := &fakeCollection{}
+	if err := commitBatch(c, muts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.bulks) != 2 {
+		t.Fatalf("got %d Bulk() calls, want 2 for %d ops with maxBulkOps=%d", len(c.bulks), n, maxBulkOps)
+	}
+	total := 0
+	for _, b := range c.bulks {
+		if b.runs != 1 {
+			t.Errorf("chunk ran Run() %d times, want 1", b.runs)
+		}
+		total += b.upserts
+	}
+	if total != n {
+		t.Errorf("got %d total upserts across chunks, want %d", total, n)
+	}
+}